@@ -15,12 +15,41 @@
 package fuse
 
 import (
-	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strings"
+	"time"
 
 	"github.com/jacobsa/bazilfuse"
 	"golang.org/x/net/context"
 )
 
+// MountError describes the failure of a single mount operation. The
+// underlying error can be recovered with errors.Unwrap, errors.Is, or
+// errors.As, which is useful for distinguishing bazilfuse sentinel errors
+// from other failures.
+type MountError struct {
+	// The operation that failed, e.g. "bazilfuse.Mount" or "Serve".
+	Op string
+
+	// The directory the operation was attempted on.
+	Dir string
+
+	// The underlying error returned by bazilfuse.
+	Err error
+}
+
+func (e *MountError) Error() string {
+	return fmt.Sprintf("%s(%q): %v", e.Op, e.Dir, e.Err)
+}
+
+func (e *MountError) Unwrap() error {
+	return e.Err
+}
+
 // A struct representing the status of a mount operation, with methods for
 // waiting on the mount to complete, waiting for unmounting, and causing
 // unmounting.
@@ -75,6 +104,116 @@ func (mfs *MountedFileSystem) Unmount() error {
 	return bazilfuse.Unmount(mfs.dir)
 }
 
+// Options accepted by UnmountWithContext.
+type UnmountOptions struct {
+	// If the mount point is still busy when ctx expires, fall back to a
+	// forceful unmount (`fusermount -u -z` on Linux, `diskutil unmount
+	// force` on Darwin) instead of returning an error.
+	Force bool
+}
+
+const unmountInitialBackoff = 50 * time.Millisecond
+const unmountMaxBackoff = 2 * time.Second
+
+// Overridable for testing. bazilfuse.Unmount shells out to fusermount/umount
+// and reports busyness as a plain formatted error string (e.g. containing
+// "resource busy") rather than one that wraps syscall.EBUSY, so callers must
+// match on the message -- see isEBUSYError below.
+var bazilfuseUnmount = bazilfuse.Unmount
+
+// Return true if err looks like it came from attempting to unmount a busy
+// mount point (e.g. a shell is cd'd into it, or a file handle is still
+// open). bazilfuse reports this as a formatted string from the underlying
+// fusermount/umount command rather than as a wrapped syscall.EBUSY, so we
+// have to match on the message it's known to contain.
+func isEBUSYError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "busy")
+}
+
+// Attempt to unmount the file system, retrying with exponential backoff as
+// long as the mount point appears to be busy -- a common transient
+// condition when a shell is cd'd into it or a file handle is still open.
+// Retries stop once ctx is done, at which point the most recent error is
+// returned unless opts.Force is set, in which case a platform-specific
+// forceful unmount is attempted as a last resort.
+//
+// As with Unmount, you must first call WaitForReady to ensure there is no
+// race with mounting, and Join should be used afterward to wait for the
+// unmount to complete.
+func (mfs *MountedFileSystem) UnmountWithContext(
+	ctx context.Context,
+	opts UnmountOptions) (err error) {
+	backoff := unmountInitialBackoff
+	for {
+		err = bazilfuseUnmount(mfs.dir)
+		if err == nil {
+			return
+		}
+
+		if !isEBUSYError(err) {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			if opts.Force {
+				return mfs.forceUnmount()
+			}
+			return
+
+		case <-time.After(backoff):
+			backoff *= 2
+			if backoff > unmountMaxBackoff {
+				backoff = unmountMaxBackoff
+			}
+		}
+	}
+}
+
+// Last-resort platform-specific forceful unmount, used by UnmountWithContext
+// when the mount point is still busy after ctx has expired.
+func (mfs *MountedFileSystem) forceUnmount() error {
+	switch runtime.GOOS {
+	case "linux":
+		return exec.Command("fusermount", "-u", "-z", mfs.dir).Run()
+
+	case "darwin":
+		return exec.Command("diskutil", "unmount", "force", mfs.dir).Run()
+
+	default:
+		return fmt.Errorf("forceUnmount: unsupported platform %q", runtime.GOOS)
+	}
+}
+
+// Install a signal handler that, upon receipt of any of the given signals,
+// attempts a graceful unmount of mfs (retrying on EBUSY, falling back to a
+// forceful unmount) and then waits for it to finish. Intended for use by
+// long-running daemons that want Ctrl-C / SIGTERM to clean up the mount
+// point instead of leaving it behind.
+func HandleSignals(mfs *MountedFileSystem, sigs ...os.Signal) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigs...)
+
+	go func() {
+		<-c
+
+		ctx, cancel := context.WithTimeout(context.Background(), unmountMaxBackoff*10)
+		defer cancel()
+
+		if err := mfs.UnmountWithContext(ctx, UnmountOptions{Force: true}); err != nil {
+			getLogger().Println("HandleSignals: unmount failed:", err)
+			return
+		}
+
+		mfs.Join(context.Background())
+	}()
+}
+
 // Runs in the background.
 func (mfs *MountedFileSystem) mountAndServe(
 	server *server,
@@ -85,7 +224,7 @@ func (mfs *MountedFileSystem) mountAndServe(
 	logger.Println("Opening a FUSE connection.")
 	c, err := bazilfuse.Mount(mfs.dir, options...)
 	if err != nil {
-		mfs.readyStatus = errors.New("bazilfuse.Mount: " + err.Error())
+		mfs.readyStatus = &MountError{Op: "bazilfuse.Mount", Dir: mfs.dir, Err: err}
 		close(mfs.readyStatusAvailable)
 		return
 	}
@@ -99,14 +238,16 @@ func (mfs *MountedFileSystem) mountAndServe(
 		<-c.Ready
 		logger.Println("The FUSE connection is ready.")
 
-		mfs.readyStatus = c.MountError
+		if c.MountError != nil {
+			mfs.readyStatus = &MountError{Op: "bazilfuse.Mount", Dir: mfs.dir, Err: c.MountError}
+		}
 		close(mfs.readyStatusAvailable)
 	}()
 
 	// Serve the connection using the file system object.
 	logger.Println("Serving the FUSE connection.")
 	if err := server.Serve(c); err != nil {
-		mfs.joinStatus = errors.New("Serve: " + err.Error())
+		mfs.joinStatus = &MountError{Op: "Serve", Dir: mfs.dir, Err: err}
 		close(mfs.joinStatusAvailable)
 		return
 	}
@@ -117,10 +258,99 @@ func (mfs *MountedFileSystem) mountAndServe(
 
 // Optional configuration accepted by Mount.
 type MountConfig struct {
+	// Mount the file system in read-only mode. Attempts to modify the file
+	// system will return EROFS.
+	ReadOnly bool
+
+	// Allow users other than the mounting user to access the file system.
+	// Usually requires that "user_allow_other" be set in /etc/fuse.conf.
+	AllowOther bool
+
+	// Allow the root user to access the file system in addition to the
+	// mounting user. Unlike AllowOther, this does not require
+	// "user_allow_other" to be set in /etc/fuse.conf.
+	AllowRoot bool
+
+	// The name for the file system, as shown in the output of `mount` and
+	// `df`. If empty, the bazilfuse default is used.
+	FSName string
+
+	// The fstype reported to the kernel, shown as part of the "type" field
+	// in the output of `mount`. If empty, the bazilfuse default is used.
+	Subtype string
+
+	// The volume name to use on OS X. Unused on other platforms.
+	VolumeName string
+
+	// The maximum size of a speculative kernel read-ahead request, in
+	// bytes. Zero means to use the bazilfuse default.
+	MaxReadahead uint32
+
+	// Cause the kernel to do permission checking for us, rather than
+	// relying on the file system to return EPERM/EACCES as appropriate.
+	DefaultPermissions bool
+
+	// Ask OS X not to create ._* files, which hold extended attributes on
+	// file systems that don't support them natively. Unused on other
+	// platforms.
+	NoAppleDouble bool
+
+	// Ask OS X not to expose extended attributes via the com.apple.*
+	// namespace. Unused on other platforms.
+	NoAppleXattr bool
+
+	// Additional mount options not otherwise covered by this struct, passed
+	// on verbatim to bazilfuse. This is an escape hatch for options that
+	// this package does not yet know about.
+	ExtraOptions []bazilfuse.MountOption
 }
 
 // Convert to mount options to be passed to package bazilfuse.
-func (c *MountConfig) bazilfuseOptions() []bazilfuse.MountOption
+func (c *MountConfig) bazilfuseOptions() (opts []bazilfuse.MountOption) {
+	if c.ReadOnly {
+		opts = append(opts, bazilfuse.ReadOnly())
+	}
+
+	if c.AllowOther {
+		opts = append(opts, bazilfuse.AllowOther())
+	}
+
+	if c.AllowRoot {
+		opts = append(opts, bazilfuse.AllowRoot())
+	}
+
+	if c.FSName != "" {
+		opts = append(opts, bazilfuse.FSName(c.FSName))
+	}
+
+	if c.Subtype != "" {
+		opts = append(opts, bazilfuse.Subtype(c.Subtype))
+	}
+
+	if c.VolumeName != "" {
+		opts = append(opts, bazilfuse.VolumeName(c.VolumeName))
+	}
+
+	if c.MaxReadahead != 0 {
+		opts = append(opts, bazilfuse.MaxReadahead(c.MaxReadahead))
+	}
+
+	if c.DefaultPermissions {
+		opts = append(opts, bazilfuse.DefaultPermissions())
+	}
+
+	if c.NoAppleDouble {
+		opts = append(opts, bazilfuse.NoAppleDouble())
+	}
+
+	if c.NoAppleXattr {
+		opts = append(opts, bazilfuse.NoAppleXattr())
+	}
+
+	opts = append(opts, c.ExtraOptions...)
+
+	return
+}
 
 // Attempt to mount the supplied file system on the given directory.
 // mfs.WaitForReady() must be called to find out whether the mount was
@@ -147,3 +377,24 @@ func Mount(
 
 	return
 }
+
+// Like Mount, but also waits for the mount to be ready before returning,
+// surfacing any error encountered along the way instead of requiring the
+// caller to separately invoke WaitForReady.
+//
+// If ctx expires before the mount becomes ready, the background mount may
+// still succeed afterward. To avoid leaking it, the returned mfs is non-nil
+// in that case too, so the caller can still call Unmount and Join on it.
+func MountAndWait(
+	ctx context.Context,
+	dir string,
+	fs FileSystem,
+	config *MountConfig) (mfs *MountedFileSystem, err error) {
+	mfs, err = Mount(dir, fs, config)
+	if err != nil {
+		return
+	}
+
+	err = mfs.WaitForReady(ctx)
+	return
+}
@@ -0,0 +1,169 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/bazilfuse"
+	"golang.org/x/net/context"
+)
+
+func TestBazilfuseOptionsEmptyConfig(t *testing.T) {
+	config := &MountConfig{}
+	opts := config.bazilfuseOptions()
+
+	if len(opts) != 0 {
+		t.Errorf("expected no options for an empty config, got %d", len(opts))
+	}
+}
+
+func TestBazilfuseOptionsAllFields(t *testing.T) {
+	config := &MountConfig{
+		ReadOnly:           true,
+		AllowOther:         true,
+		AllowRoot:          true,
+		FSName:             "myfs",
+		Subtype:            "myfstype",
+		VolumeName:         "MyVolume",
+		MaxReadahead:       1 << 20,
+		DefaultPermissions: true,
+		NoAppleDouble:      true,
+		NoAppleXattr:       true,
+		ExtraOptions:       []bazilfuse.MountOption{bazilfuse.AllowDev()},
+	}
+
+	opts := config.bazilfuseOptions()
+
+	// One option per boolean/string/uint32 field that was set, plus the
+	// extra option appended verbatim.
+	const wantLen = 11
+	if len(opts) != wantLen {
+		t.Errorf("got %d options, want %d", len(opts), wantLen)
+	}
+}
+
+func TestBazilfuseOptionsZeroMaxReadahead(t *testing.T) {
+	config := &MountConfig{MaxReadahead: 0}
+	opts := config.bazilfuseOptions()
+
+	if len(opts) != 0 {
+		t.Errorf("a zero MaxReadahead should not produce an option, got %d", len(opts))
+	}
+}
+
+func TestIsEBUSYError(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("fusermount: exit status 1, \"fusermount: failed to unmount /mnt/x: Device or resource busy\""), true},
+		{errors.New("umount: /mnt/x: Resource busy"), true},
+		{errors.New("fusermount: exit status 1, \"fusermount: entry for /mnt/x not found in /etc/mtab\""), false},
+		{errors.New("no such file or directory"), false},
+	}
+
+	for _, c := range cases {
+		if got := isEBUSYError(c.err); got != c.want {
+			t.Errorf("isEBUSYError(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+// Restore the package-level unmount hook after each test that overrides it.
+func withFakeUnmount(t *testing.T, f func(dir string) error) {
+	t.Helper()
+
+	orig := bazilfuseUnmount
+	bazilfuseUnmount = f
+	t.Cleanup(func() { bazilfuseUnmount = orig })
+}
+
+func TestUnmountWithContextSucceedsImmediately(t *testing.T) {
+	calls := 0
+	withFakeUnmount(t, func(dir string) error {
+		calls++
+		return nil
+	})
+
+	mfs := &MountedFileSystem{dir: "/mnt/x"}
+	if err := mfs.UnmountWithContext(context.Background(), UnmountOptions{}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if calls != 1 {
+		t.Errorf("expected exactly one unmount attempt, got %d", calls)
+	}
+}
+
+func TestUnmountWithContextRetriesOnBusyThenSucceeds(t *testing.T) {
+	calls := 0
+	withFakeUnmount(t, func(dir string) error {
+		calls++
+		if calls < 3 {
+			return errors.New("umount: /mnt/x: Resource busy")
+		}
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	mfs := &MountedFileSystem{dir: "/mnt/x"}
+	if err := mfs.UnmountWithContext(ctx, UnmountOptions{}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if calls != 3 {
+		t.Errorf("expected three unmount attempts, got %d", calls)
+	}
+}
+
+func TestUnmountWithContextReturnsImmediatelyOnNonBusyError(t *testing.T) {
+	calls := 0
+	wantErr := errors.New("no such file or directory")
+	withFakeUnmount(t, func(dir string) error {
+		calls++
+		return wantErr
+	})
+
+	mfs := &MountedFileSystem{dir: "/mnt/x"}
+	err := mfs.UnmountWithContext(context.Background(), UnmountOptions{})
+	if err != wantErr {
+		t.Errorf("got error %v, want %v", err, wantErr)
+	}
+
+	if calls != 1 {
+		t.Errorf("expected exactly one unmount attempt for a non-busy error, got %d", calls)
+	}
+}
+
+func TestUnmountWithContextGivesUpWhenContextExpires(t *testing.T) {
+	withFakeUnmount(t, func(dir string) error {
+		return errors.New("Device or resource busy")
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	mfs := &MountedFileSystem{dir: "/mnt/x"}
+	err := mfs.UnmountWithContext(ctx, UnmountOptions{})
+	if err == nil || !isEBUSYError(err) {
+		t.Errorf("expected a busy error once the context expires, got %v", err)
+	}
+}